@@ -0,0 +1,249 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package discoverymapper provides a meta.RESTMapper kept continuously up to date from the
+// kube-aggregator's merged aggregated discovery document, instead of periodically re-fetching
+// /apis over HTTP the way client-go's DeferredDiscoveryRESTMapper does.
+package discoverymapper
+
+import (
+	"sync"
+
+	apidiscoveryv2beta1 "k8s.io/api/apidiscovery/v2beta1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/kube-aggregator/pkg/apiserver"
+)
+
+// Source is anything that can push discovery document snapshots to interested listeners. The
+// kube-aggregator apiserver.DiscoveryManager satisfies this.
+type Source interface {
+	AddListener(listener apiserver.DiscoverySnapshotListener)
+}
+
+// resourceInfo is everything the mapper needs to know about a single resource, indexed by its
+// GroupVersionKind.
+type resourceInfo struct {
+	resource schema.GroupVersionResource
+	scope    meta.RESTScope
+}
+
+// Mapper is a meta.RESTMapper backed by a merged aggregated discovery document that is pushed to
+// it by a Source, rather than pulled over HTTP. It is safe for concurrent use, and its view of
+// the cluster is replaced wholesale every time the Source produces a new snapshot.
+type Mapper struct {
+	mu sync.RWMutex
+
+	kindForResource   map[schema.GroupVersionResource]schema.GroupVersionKind
+	resourceForKind   map[schema.GroupVersionKind]resourceInfo
+	kindsByGroupKind  map[schema.GroupKind][]schema.GroupVersionKind
+	singularResources map[string]string
+	shortNames        map[string][]schema.GroupVersionResource
+	categories        map[string][]schema.GroupVersionResource
+}
+
+var _ meta.RESTMapper = &Mapper{}
+
+// New returns a Mapper that registers itself with source and is kept current by it for as long
+// as source keeps producing snapshots.
+func New(source Source) *Mapper {
+	m := &Mapper{}
+	source.AddListener(m.reset)
+	return m
+}
+
+// reset replaces the mapper's entire view of the cluster with the one described by groups. It is
+// called by the Source once up front with the current snapshot, and again every time the merged
+// discovery document changes.
+func (m *Mapper) reset(groups []apidiscoveryv2beta1.APIGroupDiscovery) {
+	kindForResource := map[schema.GroupVersionResource]schema.GroupVersionKind{}
+	resourceForKind := map[schema.GroupVersionKind]resourceInfo{}
+	kindsByGroupKind := map[schema.GroupKind][]schema.GroupVersionKind{}
+	singularResources := map[string]string{}
+	shortNames := map[string][]schema.GroupVersionResource{}
+	categories := map[string][]schema.GroupVersionResource{}
+
+	for _, group := range groups {
+		for _, version := range group.Versions {
+			for _, res := range version.Resources {
+				if res.ResponseKind == nil {
+					continue
+				}
+
+				gvr := schema.GroupVersionResource{Group: group.Name, Version: version.Version, Resource: res.Resource}
+				gvk := schema.GroupVersionKind{Group: group.Name, Version: version.Version, Kind: res.ResponseKind.Kind}
+				gk := gvk.GroupKind()
+
+				scope := meta.RESTScopeRoot
+				if string(res.Scope) == "Namespaced" {
+					scope = meta.RESTScopeNamespace
+				}
+
+				kindForResource[gvr] = gvk
+				resourceForKind[gvk] = resourceInfo{resource: gvr, scope: scope}
+				kindsByGroupKind[gk] = append(kindsByGroupKind[gk], gvk)
+				singularResources[res.Resource] = res.SingularResource
+
+				for _, short := range res.ShortNames {
+					shortNames[short] = append(shortNames[short], gvr)
+				}
+				for _, category := range res.Categories {
+					categories[category] = append(categories[category], gvr)
+				}
+			}
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.kindForResource = kindForResource
+	m.resourceForKind = resourceForKind
+	m.kindsByGroupKind = kindsByGroupKind
+	m.singularResources = singularResources
+	m.shortNames = shortNames
+	m.categories = categories
+}
+
+// candidatesForResourceLocked returns every known GroupVersionResource whose resource name (or
+// short name) matches resource. mu must be held by the caller.
+func (m *Mapper) candidatesForResourceLocked(resource string) []schema.GroupVersionResource {
+	var out []schema.GroupVersionResource
+	for gvr := range m.kindForResource {
+		if gvr.Resource == resource {
+			out = append(out, gvr)
+		}
+	}
+	if len(out) > 0 {
+		return out
+	}
+	return m.shortNames[resource]
+}
+
+func (m *Mapper) KindFor(resource schema.GroupVersionResource) (schema.GroupVersionKind, error) {
+	kinds, err := m.KindsFor(resource)
+	if err != nil {
+		return schema.GroupVersionKind{}, err
+	}
+	if len(kinds) != 1 {
+		return schema.GroupVersionKind{}, &meta.AmbiguousResourceError{PartialResource: resource, MatchingKinds: kinds}
+	}
+	return kinds[0], nil
+}
+
+func (m *Mapper) KindsFor(input schema.GroupVersionResource) ([]schema.GroupVersionKind, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if input.Version != "" && input.Group != "" {
+		if gvk, ok := m.kindForResource[input]; ok {
+			return []schema.GroupVersionKind{gvk}, nil
+		}
+		return nil, &meta.NoResourceMatchError{PartialResource: input}
+	}
+
+	var matches []schema.GroupVersionKind
+	for _, gvr := range m.candidatesForResourceLocked(input.Resource) {
+		if input.Group != "" && gvr.Group != input.Group {
+			continue
+		}
+		if input.Version != "" && gvr.Version != input.Version {
+			continue
+		}
+		matches = append(matches, m.kindForResource[gvr])
+	}
+	if len(matches) == 0 {
+		return nil, &meta.NoResourceMatchError{PartialResource: input}
+	}
+	return matches, nil
+}
+
+func (m *Mapper) ResourceFor(input schema.GroupVersionResource) (schema.GroupVersionResource, error) {
+	resources, err := m.ResourcesFor(input)
+	if err != nil {
+		return schema.GroupVersionResource{}, err
+	}
+	if len(resources) != 1 {
+		return schema.GroupVersionResource{}, &meta.AmbiguousResourceError{PartialResource: input, MatchingResources: resources}
+	}
+	return resources[0], nil
+}
+
+func (m *Mapper) ResourcesFor(input schema.GroupVersionResource) ([]schema.GroupVersionResource, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var matches []schema.GroupVersionResource
+	for _, gvr := range m.candidatesForResourceLocked(input.Resource) {
+		if input.Group != "" && gvr.Group != input.Group {
+			continue
+		}
+		if input.Version != "" && gvr.Version != input.Version {
+			continue
+		}
+		matches = append(matches, gvr)
+	}
+	if len(matches) == 0 {
+		return nil, &meta.NoResourceMatchError{PartialResource: input}
+	}
+	return matches, nil
+}
+
+func (m *Mapper) RESTMapping(gk schema.GroupKind, versions ...string) (*meta.RESTMapping, error) {
+	mappings, err := m.RESTMappings(gk, versions...)
+	if err != nil {
+		return nil, err
+	}
+	return mappings[0], nil
+}
+
+func (m *Mapper) RESTMappings(gk schema.GroupKind, versions ...string) ([]*meta.RESTMapping, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	wanted := map[string]bool{}
+	for _, v := range versions {
+		wanted[v] = true
+	}
+
+	var mappings []*meta.RESTMapping
+	for _, gvk := range m.kindsByGroupKind[gk] {
+		if len(wanted) > 0 && !wanted[gvk.Version] {
+			continue
+		}
+		info, ok := m.resourceForKind[gvk]
+		if !ok {
+			continue
+		}
+		mappings = append(mappings, &meta.RESTMapping{
+			Resource:         info.resource,
+			GroupVersionKind: gvk,
+			Scope:            info.scope,
+		})
+	}
+	if len(mappings) == 0 {
+		return nil, &meta.NoKindMatchError{GroupKind: gk, SearchedVersions: versions}
+	}
+	return mappings, nil
+}
+
+func (m *Mapper) ResourceSingularizer(resource string) (string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if singular, ok := m.singularResources[resource]; ok {
+		return singular, nil
+	}
+	return resource, nil
+}
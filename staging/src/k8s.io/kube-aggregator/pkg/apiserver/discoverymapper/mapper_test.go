@@ -0,0 +1,105 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package discoverymapper_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	apidiscoveryv2beta1 "k8s.io/api/apidiscovery/v2beta1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	discoveryendpoint "k8s.io/apiserver/pkg/endpoints/discovery/aggregated"
+	"k8s.io/kube-aggregator/pkg/apiserver"
+	"k8s.io/kube-aggregator/pkg/apiserver/discoverymapper"
+	apiregistrationv1 "k8s.io/kube-aggregator/pkg/apis/apiregistration/v1"
+)
+
+func widgetGroup() apidiscoveryv2beta1.APIGroupDiscovery {
+	return apidiscoveryv2beta1.APIGroupDiscovery{
+		ObjectMeta: metav1.ObjectMeta{Name: "stable.example.com"},
+		Versions: []apidiscoveryv2beta1.APIVersionDiscovery{
+			{
+				Version: "v1",
+				Resources: []apidiscoveryv2beta1.APIResourceDiscovery{
+					{
+						Resource:         "widgets",
+						SingularResource: "widget",
+						ResponseKind:     &metav1.GroupVersionKind{Group: "stable.example.com", Version: "v1", Kind: "Widget"},
+						Scope:            apidiscoveryv2beta1.ScopeNamespace,
+						ShortNames:       []string{"wd"},
+					},
+				},
+			},
+		},
+	}
+}
+
+// TestMapperTracksAPIServices shows that a Mapper built over a live DiscoveryManager reflects
+// AddAPIService/RemoveAPIService without ever issuing an HTTP request of its own.
+func TestMapperTracksAPIServices(t *testing.T) {
+	backend := discoveryendpoint.NewResourceManager()
+	backend.SetGroups([]apidiscoveryv2beta1.APIGroupDiscovery{widgetGroup()})
+
+	aggregatedResourceManager := discoveryendpoint.NewResourceManager()
+	dm := apiserver.NewDiscoveryManager(aggregatedResourceManager)
+	mapper := discoverymapper.New(dm)
+
+	widget := schema.GroupVersionResource{Group: "stable.example.com", Version: "v1", Resource: "widgets"}
+
+	// Nothing registered yet: the mapper shouldn't know about the resource.
+	_, err := mapper.KindFor(widget)
+	require.Error(t, err)
+
+	testCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go dm.Run(testCtx.Done())
+
+	apiService := &apiregistrationv1.APIService{
+		ObjectMeta: metav1.ObjectMeta{Name: "v1.stable.example.com"},
+		Spec: apiregistrationv1.APIServiceSpec{
+			Group:   "stable.example.com",
+			Version: "v1",
+			Service: &apiregistrationv1.ServiceReference{Name: "backend"},
+		},
+	}
+	dm.AddAPIService(apiService, backend)
+
+	require.Eventually(t, func() bool {
+		gvk, err := mapper.KindFor(widget)
+		return err == nil && gvk.Kind == "Widget"
+	}, 2*time.Second, 10*time.Millisecond, "mapper never picked up the added APIService")
+
+	mapping, err := mapper.RESTMapping(schema.GroupKind{Group: "stable.example.com", Kind: "Widget"}, "v1")
+	require.NoError(t, err)
+	require.Equal(t, widget, mapping.Resource)
+	require.Equal(t, meta.RESTScopeNamespace.Name(), mapping.Scope.Name())
+
+	resources, err := mapper.ResourcesFor(schema.GroupVersionResource{Resource: "wd"})
+	require.NoError(t, err)
+	require.Equal(t, []schema.GroupVersionResource{widget}, resources)
+
+	dm.RemoveAPIService(apiService.Name)
+
+	require.Eventually(t, func() bool {
+		_, err := mapper.KindFor(widget)
+		return err != nil
+	}, 2*time.Second, 10*time.Millisecond, "mapper never noticed the APIService was removed")
+}
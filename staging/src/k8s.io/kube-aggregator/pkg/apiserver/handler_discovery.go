@@ -0,0 +1,790 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apiserver
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	apidiscoveryv2beta1 "k8s.io/api/apidiscovery/v2beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apiserver/pkg/endpoints"
+	discoveryendpoint "k8s.io/apiserver/pkg/endpoints/discovery/aggregated"
+	scheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/util/workqueue"
+	apiregistrationv1 "k8s.io/kube-aggregator/pkg/apis/apiregistration/v1"
+)
+
+// aggregatedDiscoveryAccept is the Accept header aggregated APIServices are
+// expected to honor in order to serve the merged apidiscovery.k8s.io v2beta1
+// document instead of their legacy metav1.APIGroup/APIResourceList documents.
+const aggregatedDiscoveryAccept = runtime.ContentTypeJSON + ";g=apidiscovery.k8s.io;v=v2beta1;as=APIGroupDiscoveryList"
+
+const (
+	// defaultDiscoveryManagerParallelism is the number of workers that concurrently drain
+	// dirtyAPIServiceQueue when the caller doesn't pick one with WithParallelism.
+	defaultDiscoveryManagerParallelism = 2
+
+	// defaultPerAPIServiceRequestTimeout bounds how long a single sync waits on a delegated
+	// APIService's handler before giving up, when the caller doesn't pick one with
+	// WithPerRequestTimeout.
+	defaultPerAPIServiceRequestTimeout = 5 * time.Second
+
+	// circuitBreakerMaxConsecutiveFailures is the number of consecutive failed syncs after which
+	// an APIService's contribution to the merged document is marked Stale rather than dropped.
+	// Retries are backed off by the queue's rate limiter from the first failure onwards.
+	circuitBreakerMaxConsecutiveFailures = 3
+)
+
+// DiscoveryManager keeps track of the discovery document for a list of APIServices and updates
+// them when they change.
+type DiscoveryManager interface {
+	// AddAPIService adds an APIService to be tracked by the discovery manager. If the APIService
+	// is already known, the discovery manager will re-fetch the discovery document for it the
+	// next time it is synced.
+	AddAPIService(apiService *apiregistrationv1.APIService, handler http.Handler)
+
+	// RemoveAPIService removes an APIService from being tracked, and removes its contribution to
+	// the merged discovery document the next time it is synced.
+	RemoveAPIService(apiServiceName string)
+
+	// Run starts the manager and blocks, reconciling the merged discovery document until stopCh
+	// is closed.
+	Run(stopCh <-chan struct{})
+
+	// AddListener registers listener to be called with the current merged discovery document
+	// snapshot immediately, and again every time a new snapshot is produced thereafter. Consumers
+	// that need a live view of the merged document (e.g. discoverymapper) should use this instead
+	// of polling the served HTTP endpoint.
+	AddListener(listener DiscoverySnapshotListener)
+}
+
+// DiscoverySnapshotListener is called with the full merged discovery document every time it
+// changes. Implementations must not retain or mutate groups beyond the call.
+type DiscoverySnapshotListener func(groups []apidiscoveryv2beta1.APIGroupDiscovery)
+
+// discoveryManager aggregates the discovery document for every registered APIService into a
+// single document served by resourceManager. Each time an APIService is added, removed, or
+// believed to have changed, its name is pushed onto dirtyAPIServiceQueue; the Run loop drains
+// that queue, re-fetches the affected APIService's discovery document, and rebuilds the merged
+// document.
+type discoveryManager struct {
+	resourceManager discoveryendpoint.ResourceManager
+
+	mu              sync.RWMutex
+	liveAPIServices map[string]*apiregistrationv1.APIService
+	handlers        map[string]http.Handler
+
+	// cachedResultsLock guards cachedResults and aggregatedETags, which are read whenever the
+	// merged document is rebuilt and written whenever an APIService's own document changes.
+	cachedResultsLock sync.RWMutex
+	// cachedResults holds the most recently fetched discovery groups contributed by each known
+	// APIService, keyed by APIService name.
+	cachedResults map[string][]apidiscoveryv2beta1.APIGroupDiscovery
+	// aggregatedETags holds the last observed ETag of the aggregated (v2beta1) discovery
+	// response for each APIService, used to avoid re-fetching when nothing has changed.
+	aggregatedETags map[string]string
+	// stale holds the names of APIServices whose circuit breaker has tripped: their entry in
+	// cachedResults is their last known-good content, but it must be served with a Stale
+	// freshness until a sync succeeds again. Tracked separately from cachedResults so that a
+	// successful-but-unchanged sync (a 304, or an unchanged legacy body hash) still clears it.
+	stale map[string]bool
+
+	// legacyFetchCache holds the ETag/body-hash cache used when an APIService doesn't speak the
+	// aggregated discovery protocol and we must fall back to its legacy documents.
+	legacyFetchCache *legacyDiscoveryCache
+
+	// lastMerged is the most recently published merged document, kept alongside resourceManager
+	// so AddListener can hand new subscribers the current snapshot without waiting for the next
+	// rebuild.
+	lastMerged []apidiscoveryv2beta1.APIGroupDiscovery
+
+	listenersLock sync.Mutex
+	listeners     []DiscoverySnapshotListener
+
+	dirtyAPIServiceQueue workqueue.RateLimitingInterface
+
+	// workers is the number of goroutines that concurrently drain dirtyAPIServiceQueue, so that a
+	// slow or hung APIService can't starve the others.
+	workers int
+	// perRequestTimeout bounds how long a single sync waits on a delegated APIService's handler.
+	perRequestTimeout time.Duration
+}
+
+// DiscoveryManagerOption customizes a DiscoveryManager returned by NewDiscoveryManager.
+type DiscoveryManagerOption func(*discoveryManager)
+
+// WithParallelism sets the number of workers that concurrently drain dirtyAPIServiceQueue.
+// Defaults to defaultDiscoveryManagerParallelism.
+func WithParallelism(workers int) DiscoveryManagerOption {
+	return func(dm *discoveryManager) { dm.workers = workers }
+}
+
+// WithPerRequestTimeout sets how long a single sync waits on a delegated APIService's handler
+// before giving up and treating the sync as failed. Defaults to
+// defaultPerAPIServiceRequestTimeout.
+func WithPerRequestTimeout(timeout time.Duration) DiscoveryManagerOption {
+	return func(dm *discoveryManager) { dm.perRequestTimeout = timeout }
+}
+
+// NewDiscoveryManager returns a DiscoveryManager which serves its merged discovery document
+// through target.
+func NewDiscoveryManager(target discoveryendpoint.ResourceManager, opts ...DiscoveryManagerOption) DiscoveryManager {
+	dm := &discoveryManager{
+		resourceManager:      target,
+		liveAPIServices:      map[string]*apiregistrationv1.APIService{},
+		handlers:             map[string]http.Handler{},
+		cachedResults:        map[string][]apidiscoveryv2beta1.APIGroupDiscovery{},
+		aggregatedETags:      map[string]string{},
+		stale:                map[string]bool{},
+		legacyFetchCache:     newLegacyDiscoveryCache(),
+		dirtyAPIServiceQueue: workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "discovery-manager"),
+		workers:              defaultDiscoveryManagerParallelism,
+		perRequestTimeout:    defaultPerAPIServiceRequestTimeout,
+	}
+	for _, opt := range opts {
+		opt(dm)
+	}
+	return dm
+}
+
+func (dm *discoveryManager) AddAPIService(apiService *apiregistrationv1.APIService, handler http.Handler) {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	dm.liveAPIServices[apiService.Name] = apiService
+	dm.handlers[apiService.Name] = handler
+	dm.dirtyAPIServiceQueue.Add(apiService.Name)
+}
+
+func (dm *discoveryManager) RemoveAPIService(apiServiceName string) {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	delete(dm.liveAPIServices, apiServiceName)
+	delete(dm.handlers, apiServiceName)
+	dm.dirtyAPIServiceQueue.Add(apiServiceName)
+}
+
+func (dm *discoveryManager) AddListener(listener DiscoverySnapshotListener) {
+	dm.cachedResultsLock.RLock()
+	current := dm.lastMerged
+	dm.cachedResultsLock.RUnlock()
+
+	dm.listenersLock.Lock()
+	dm.listeners = append(dm.listeners, listener)
+	dm.listenersLock.Unlock()
+
+	listener(current)
+}
+
+func (dm *discoveryManager) notifyListeners(groups []apidiscoveryv2beta1.APIGroupDiscovery) {
+	dm.listenersLock.Lock()
+	listeners := append([]DiscoverySnapshotListener(nil), dm.listeners...)
+	dm.listenersLock.Unlock()
+
+	for _, listener := range listeners {
+		listener(groups)
+	}
+}
+
+func (dm *discoveryManager) Run(stopCh <-chan struct{}) {
+	defer dm.dirtyAPIServiceQueue.ShutDown()
+
+	klog.Info("Starting ResourceDiscoveryManager")
+	defer klog.Info("Shutting down ResourceDiscoveryManager")
+
+	go func() {
+		<-stopCh
+		dm.dirtyAPIServiceQueue.ShutDown()
+	}()
+
+	workers := dm.workers
+	if workers < 1 {
+		workers = 1
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for dm.processNextWorkItem() {
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// processNextWorkItem syncs a single dirty APIService. A sync that keeps failing is requeued with
+// the queue's own rate limiter rather than forgotten, which is what gives a persistently failing
+// APIService its exponential backoff; once it has failed circuitBreakerMaxConsecutiveFailures
+// times in a row its merged entry is marked Stale until a sync finally succeeds again.
+func (dm *discoveryManager) processNextWorkItem() bool {
+	next, shutdown := dm.dirtyAPIServiceQueue.Get()
+	if shutdown {
+		return false
+	}
+	defer dm.dirtyAPIServiceQueue.Done(next)
+
+	name := next.(string)
+
+	if err := dm.syncAPIService(name); err != nil {
+		consecutiveFailures := dm.dirtyAPIServiceQueue.NumRequeues(next) + 1
+		discoverySyncFailuresTotal.WithLabelValues(name).Inc()
+		klog.Warningf("failed to sync discovery document for APIService %q (attempt %d): %v", name, consecutiveFailures, err)
+
+		if consecutiveFailures >= circuitBreakerMaxConsecutiveFailures {
+			discoverySyncCircuitOpen.WithLabelValues(name).Set(1)
+			dm.markAPIServiceStale(name)
+		}
+
+		dm.dirtyAPIServiceQueue.AddRateLimited(next)
+		return true
+	}
+
+	dm.mu.RLock()
+	_, stillExists := dm.liveAPIServices[name]
+	dm.mu.RUnlock()
+	if stillExists {
+		discoverySyncCircuitOpen.WithLabelValues(name).Set(0)
+	}
+	dm.dirtyAPIServiceQueue.Forget(next)
+	return true
+}
+
+// syncAPIService re-fetches the discovery document contributed by the named APIService (or
+// forgets it, if it has been removed) and rebuilds the merged document if anything changed. The
+// delegated handler call is bounded by perRequestTimeout so a hung APIService can't tie up a
+// worker indefinitely. A successful sync always clears a prior Stale flag, even if the fetched
+// content is unchanged from what was already cached -- otherwise an APIService that recovers from
+// a transient failure without its content actually changing would be stuck Stale forever.
+func (dm *discoveryManager) syncAPIService(name string) error {
+	dm.mu.RLock()
+	apiService, stillExists := dm.liveAPIServices[name]
+	handler := dm.handlers[name]
+	dm.mu.RUnlock()
+
+	if !stillExists {
+		dm.forgetAPIService(name)
+		dm.rebuildMergedDocument()
+		return nil
+	}
+
+	handler = timeoutHandler{delegate: handler, timeout: dm.perRequestTimeout}
+
+	start := time.Now()
+	groups, unchanged, err := dm.fetchAggregatedDiscovery(handler, name)
+	if err != nil {
+		groups, unchanged, err = dm.fetchLegacyDiscovery(handler, apiService)
+	}
+	discoverySyncDuration.WithLabelValues(name).Observe(time.Since(start).Seconds())
+
+	if err != nil {
+		return err
+	}
+
+	dm.cachedResultsLock.Lock()
+	wasStale := dm.stale[name]
+	delete(dm.stale, name)
+	if !unchanged {
+		dm.cachedResults[name] = groups
+	}
+	dm.cachedResultsLock.Unlock()
+
+	if unchanged && !wasStale {
+		return nil
+	}
+
+	dm.rebuildMergedDocument()
+	return nil
+}
+
+func (dm *discoveryManager) forgetAPIService(name string) {
+	dm.cachedResultsLock.Lock()
+	delete(dm.cachedResults, name)
+	delete(dm.aggregatedETags, name)
+	delete(dm.stale, name)
+	dm.cachedResultsLock.Unlock()
+	dm.legacyFetchCache.forget(name)
+
+	// Drop this APIService's per-name series so they don't accumulate without bound across
+	// APIService churn over the life of the process.
+	discoverySyncDuration.DeleteLabelValues(name)
+	discoverySyncFailuresTotal.DeleteLabelValues(name)
+	discoverySyncCircuitOpen.DeleteLabelValues(name)
+}
+
+// markAPIServiceStale flags name's last known-good sync as Stale in the merged document, without
+// dropping it, so that consumers can tell a circuit-broken APIService apart from one that was
+// never reachable at all. The flag lives in dm.stale rather than being baked into cachedResults,
+// so that the next successful sync -- even one that finds the content unchanged -- can clear it.
+func (dm *discoveryManager) markAPIServiceStale(name string) {
+	dm.cachedResultsLock.Lock()
+	if _, ok := dm.cachedResults[name]; !ok {
+		dm.cachedResultsLock.Unlock()
+		return
+	}
+	dm.stale[name] = true
+	dm.cachedResultsLock.Unlock()
+
+	dm.rebuildMergedDocument()
+}
+
+// fetchAggregatedDiscovery asks handler for its apidiscovery.k8s.io v2beta1 document. It returns
+// an error if the handler doesn't speak the aggregated protocol (wrong content type, non-200/304
+// status, or a decode failure), in which case the caller should fall back to legacy discovery.
+func (dm *discoveryManager) fetchAggregatedDiscovery(handler http.Handler, apiServiceName string) ([]apidiscoveryv2beta1.APIGroupDiscovery, bool, error) {
+	req, err := http.NewRequest(http.MethodGet, "/apis", nil)
+	if err != nil {
+		return nil, false, err
+	}
+	req.Header.Set("Accept", aggregatedDiscoveryAccept)
+
+	dm.cachedResultsLock.RLock()
+	previousETag := dm.aggregatedETags[apiServiceName]
+	dm.cachedResultsLock.RUnlock()
+	if previousETag != "" {
+		req.Header.Set("If-None-Match", previousETag)
+	}
+
+	w := newInMemoryResponseWriter()
+	handler.ServeHTTP(w, req)
+
+	if w.code == http.StatusNotModified {
+		dm.cachedResultsLock.RLock()
+		cached, ok := dm.cachedResults[apiServiceName]
+		dm.cachedResultsLock.RUnlock()
+		if !ok {
+			return nil, false, fmt.Errorf("received 304 Not Modified with no cached discovery document")
+		}
+		return cached, true, nil
+	}
+	if w.code != http.StatusOK {
+		return nil, false, fmt.Errorf("not served via the aggregated discovery protocol (status %d)", w.code)
+	}
+
+	mediaType, params, err := mime.ParseMediaType(w.Header().Get("Content-Type"))
+	if err != nil || mediaType != runtime.ContentTypeJSON || params["as"] != "APIGroupDiscoveryList" {
+		return nil, false, fmt.Errorf("not served via the aggregated discovery protocol")
+	}
+
+	var parsed apidiscoveryv2beta1.APIGroupDiscoveryList
+	if err := runtime.DecodeInto(scheme.Codecs.UniversalDecoder(), w.body.Bytes(), &parsed); err != nil {
+		return nil, false, fmt.Errorf("decoding aggregated discovery document: %w", err)
+	}
+
+	dm.cachedResultsLock.Lock()
+	dm.aggregatedETags[apiServiceName] = w.Header().Get("ETag")
+	dm.cachedResultsLock.Unlock()
+
+	return parsed.Items, false, nil
+}
+
+// fetchLegacyDiscovery reconstructs a single-group, single-version discovery document for
+// apiService by walking its legacy /apis, /apis/<group> and /apis/<group>/<version> endpoints,
+// the same sequence a pre-aggregated-discovery APIService is expected to serve.
+func (dm *discoveryManager) fetchLegacyDiscovery(handler http.Handler, apiService *apiregistrationv1.APIService) ([]apidiscoveryv2beta1.APIGroupDiscovery, bool, error) {
+	group := apiService.Spec.Group
+	version := apiService.Spec.Version
+
+	if _, _, err := dm.legacyFetchCache.get(handler, apiService.Name, "/apis"); err != nil {
+		return nil, false, fmt.Errorf("fetching /apis: %w", err)
+	}
+
+	if _, _, err := dm.legacyFetchCache.getAPIGroup(handler, apiService.Name, group); err != nil {
+		return nil, false, fmt.Errorf("fetching legacy group %q: %w", group, err)
+	}
+
+	versionDiscovery, unchanged, err := dm.legacyFetchCache.getAPIVersion(handler, apiService.Name, schema.GroupVersion{Group: group, Version: version})
+	if err != nil {
+		return nil, false, fmt.Errorf("fetching legacy resources for %s/%s: %w", group, version, err)
+	}
+
+	return []apidiscoveryv2beta1.APIGroupDiscovery{
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: group},
+			Versions:   []apidiscoveryv2beta1.APIVersionDiscovery{*versionDiscovery},
+		},
+	}, unchanged, nil
+}
+
+// rebuildMergedDocument recomputes the full merged discovery document from the cached per
+// APIService results and publishes it through resourceManager. APIServices flagged Stale in
+// dm.stale have their versions' Freshness overridden at merge time, rather than that being baked
+// into cachedResults, so that a later successful sync can clear it unconditionally. notifyListeners
+// is called after cachedResultsLock is released, since listeners (e.g. discoverymapper) may call
+// back into DiscoveryManager and must not do so while its internal lock is held.
+func (dm *discoveryManager) rebuildMergedDocument() {
+	dm.cachedResultsLock.Lock()
+
+	byGroup := map[string]*apidiscoveryv2beta1.APIGroupDiscovery{}
+	var order []string
+	for name, groups := range dm.cachedResults {
+		stale := dm.stale[name]
+		for _, g := range groups {
+			if stale {
+				g.Versions = append([]apidiscoveryv2beta1.APIVersionDiscovery(nil), g.Versions...)
+				for j := range g.Versions {
+					g.Versions[j].Freshness = apidiscoveryv2beta1.DiscoveryFreshnessStale
+				}
+			}
+			existing, ok := byGroup[g.Name]
+			if !ok {
+				gCopy := g
+				byGroup[g.Name] = &gCopy
+				order = append(order, g.Name)
+				continue
+			}
+			existing.Versions = append(existing.Versions, g.Versions...)
+		}
+	}
+
+	merged := make([]apidiscoveryv2beta1.APIGroupDiscovery, 0, len(order))
+	for _, name := range order {
+		g := byGroup[name]
+		sort.SliceStable(g.Versions, func(i, j int) bool {
+			return compareAPIVersions(g.Versions[i].Version, g.Versions[j].Version) < 0
+		})
+		merged = append(merged, *g)
+	}
+
+	// dm.cachedResults is a map, so order (and therefore the iteration above) isn't stable across
+	// rebuilds. Sort by group name so that an unchanged cache always produces byte-for-byte
+	// identical output -- and therefore the same aggregated ETag -- regardless of map iteration
+	// order.
+	sort.Slice(merged, func(i, j int) bool {
+		return merged[i].Name < merged[j].Name
+	})
+
+	dm.lastMerged = merged
+	dm.resourceManager.SetGroups(merged)
+	dm.cachedResultsLock.Unlock()
+
+	dm.notifyListeners(merged)
+}
+
+// legacyDiscoveryCache is a per-(APIService, URL) ETag/body-hash cache used when falling back to
+// an APIService's legacy discovery documents. Unlike the aggregated protocol, legacy discovery
+// handlers don't implement conditional GETs themselves, so alongside the ETag we send we also
+// remember a hash of the last body we saw: if the handler ignores If-None-Match and returns 200
+// anyway, we can still detect "nothing actually changed" and skip re-parsing and re-converting.
+type legacyDiscoveryCache struct {
+	mu      sync.Mutex
+	entries map[string]*legacyURLCacheEntry
+}
+
+type legacyURLCacheEntry struct {
+	etag         string
+	lastModified string
+	bodyHash     string
+
+	parsedGroup   *metav1.APIGroup
+	parsedVersion *apidiscoveryv2beta1.APIVersionDiscovery
+}
+
+func newLegacyDiscoveryCache() *legacyDiscoveryCache {
+	return &legacyDiscoveryCache{entries: map[string]*legacyURLCacheEntry{}}
+}
+
+func (c *legacyDiscoveryCache) forget(apiServiceName string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	prefix := apiServiceName + "|"
+	for key := range c.entries {
+		if strings.HasPrefix(key, prefix) {
+			delete(c.entries, key)
+		}
+	}
+}
+
+// get issues a conditional GET for url against handler. The returned bool is true if the body is
+// unchanged since the last call for this (apiServiceName, url) pair, either because the handler
+// returned 304 Not Modified or because the freshly fetched body hashes the same as before.
+func (c *legacyDiscoveryCache) get(handler http.Handler, apiServiceName, url string) ([]byte, bool, error) {
+	key := apiServiceName + "|" + url
+
+	c.mu.Lock()
+	existing := c.entries[key]
+	c.mu.Unlock()
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	if existing != nil && existing.etag != "" {
+		req.Header.Set("If-None-Match", existing.etag)
+	}
+
+	w := newInMemoryResponseWriter()
+	handler.ServeHTTP(w, req)
+
+	if w.code == http.StatusNotModified {
+		if existing == nil {
+			return nil, false, fmt.Errorf("received 304 Not Modified for %s with no prior cache entry", url)
+		}
+		return nil, true, nil
+	}
+	if w.code != http.StatusOK {
+		return nil, false, fmt.Errorf("unexpected status %d fetching %s", w.code, url)
+	}
+
+	body := w.body.Bytes()
+	sum := sha256.Sum256(body)
+	hash := hex.EncodeToString(sum[:])
+
+	if existing != nil && existing.bodyHash == hash {
+		c.mu.Lock()
+		existing.lastModified = w.Header().Get("Last-Modified")
+		c.mu.Unlock()
+		return body, true, nil
+	}
+
+	etag := w.Header().Get("ETag")
+	if etag == "" {
+		// The legacy discovery handlers don't set their own ETag, so derive a stable one from
+		// the body. This still lets us send If-None-Match to smarter delegates, and lets the
+		// hash comparison above short-circuit unconditionally-200 ones.
+		etag = strconv.Quote(hash)
+	}
+
+	c.mu.Lock()
+	c.entries[key] = &legacyURLCacheEntry{
+		etag:         etag,
+		lastModified: w.Header().Get("Last-Modified"),
+		bodyHash:     hash,
+	}
+	c.mu.Unlock()
+
+	return body, false, nil
+}
+
+func (c *legacyDiscoveryCache) getAPIGroup(handler http.Handler, apiServiceName, group string) (*metav1.APIGroup, bool, error) {
+	url := "/apis/" + group
+	body, unchanged, err := c.get(handler, apiServiceName, url)
+	if err != nil {
+		return nil, false, err
+	}
+
+	key := apiServiceName + "|" + url
+	c.mu.Lock()
+	entry := c.entries[key]
+	c.mu.Unlock()
+
+	if unchanged {
+		return entry.parsedGroup, true, nil
+	}
+
+	var parsed metav1.APIGroup
+	if err := runtime.DecodeInto(scheme.Codecs.UniversalDecoder(), body, &parsed); err != nil {
+		return nil, false, fmt.Errorf("decoding legacy API group %q: %w", group, err)
+	}
+
+	c.mu.Lock()
+	entry.parsedGroup = &parsed
+	c.mu.Unlock()
+
+	return &parsed, false, nil
+}
+
+func (c *legacyDiscoveryCache) getAPIVersion(handler http.Handler, apiServiceName string, gv schema.GroupVersion) (*apidiscoveryv2beta1.APIVersionDiscovery, bool, error) {
+	url := "/apis/" + gv.Group + "/" + gv.Version
+	body, unchanged, err := c.get(handler, apiServiceName, url)
+	if err != nil {
+		return nil, false, err
+	}
+
+	key := apiServiceName + "|" + url
+	c.mu.Lock()
+	entry := c.entries[key]
+	c.mu.Unlock()
+
+	if unchanged {
+		return entry.parsedVersion, true, nil
+	}
+
+	var resourceList metav1.APIResourceList
+	if err := runtime.DecodeInto(scheme.Codecs.UniversalDecoder(), body, &resourceList); err != nil {
+		return nil, false, fmt.Errorf("decoding legacy resource list for %s: %w", gv, err)
+	}
+
+	converted, err := endpoints.ConvertGroupVersionIntoToDiscovery(resourceList.APIResources)
+	if err != nil {
+		return nil, false, fmt.Errorf("converting legacy resource list for %s: %w", gv, err)
+	}
+
+	versionDiscovery := &apidiscoveryv2beta1.APIVersionDiscovery{
+		Version:   gv.Version,
+		Resources: converted,
+		Freshness: apidiscoveryv2beta1.DiscoveryFreshnessCurrent,
+	}
+
+	c.mu.Lock()
+	entry.parsedVersion = versionDiscovery
+	c.mu.Unlock()
+
+	return versionDiscovery, false, nil
+}
+
+// inMemoryResponseWriter is a minimal http.ResponseWriter used to invoke a delegated APIService
+// handler in-process, without going over the network.
+type inMemoryResponseWriter struct {
+	code   int
+	header http.Header
+	body   bytes.Buffer
+}
+
+func newInMemoryResponseWriter() *inMemoryResponseWriter {
+	return &inMemoryResponseWriter{code: http.StatusOK, header: http.Header{}}
+}
+
+func (w *inMemoryResponseWriter) Header() http.Header { return w.header }
+
+func (w *inMemoryResponseWriter) Write(b []byte) (int, error) { return w.body.Write(b) }
+
+func (w *inMemoryResponseWriter) WriteHeader(code int) { w.code = code }
+
+// timeoutHandler wraps delegate so that ServeHTTP gives up and returns a 504 if delegate hasn't
+// responded within timeout. On timeout, r's context is cancelled before delegate's goroutine is
+// abandoned, so a delegate that honors context cancellation (as the aggregator's own
+// reverse-proxying handlers do) can stop its own in-flight work instead of running until whatever
+// it's blocked on finally gives up on its own. A delegate that ignores cancellation still leaves
+// its goroutine running, with any writes it eventually makes discarded, guarded by a mutex so they
+// can't race with the 504 response.
+type timeoutHandler struct {
+	delegate http.Handler
+	timeout  time.Duration
+}
+
+func (t timeoutHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), t.timeout)
+	defer cancel()
+	r = r.WithContext(ctx)
+
+	var mu sync.Mutex
+	timedOut := false
+	guarded := &timeoutGuardedResponseWriter{w: w, mu: &mu, timedOut: &timedOut}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		t.delegate.ServeHTTP(guarded, r)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		// w is written directly here rather than through guarded, so timedOut must be set and the
+		// write made in the same critical section: guarded's own writes from the still-running
+		// delegate goroutine take mu before touching w, and without that same lock held here the
+		// two would race on w (and, in tests, on inMemoryResponseWriter's buffer) rather than being
+		// excluded by it.
+		mu.Lock()
+		timedOut = true
+		w.WriteHeader(http.StatusGatewayTimeout)
+		mu.Unlock()
+	}
+}
+
+type timeoutGuardedResponseWriter struct {
+	w        http.ResponseWriter
+	mu       *sync.Mutex
+	timedOut *bool
+}
+
+func (g *timeoutGuardedResponseWriter) Header() http.Header { return g.w.Header() }
+
+func (g *timeoutGuardedResponseWriter) Write(b []byte) (int, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if *g.timedOut {
+		return len(b), nil
+	}
+	return g.w.Write(b)
+}
+
+func (g *timeoutGuardedResponseWriter) WriteHeader(code int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if *g.timedOut {
+		return
+	}
+	g.w.WriteHeader(code)
+}
+
+var kubeAwareVersionPattern = regexp.MustCompile(`^v(\d+)(?:(alpha|beta)(\d+))?$`)
+
+// compareAPIVersions orders API versions the way Kubernetes discovery documents do: GA versions
+// before beta before alpha, newest major version first, and newest pre-release first within a
+// band. Versions that don't match the vN(alpha|beta)N convention sort after all that do.
+func compareAPIVersions(a, b string) int {
+	pa, okA := parseKubeAwareVersion(a)
+	pb, okB := parseKubeAwareVersion(b)
+	switch {
+	case okA && !okB:
+		return -1
+	case !okA && okB:
+		return 1
+	case !okA && !okB:
+		return strings.Compare(a, b)
+	}
+	if pa.band != pb.band {
+		return pb.band - pa.band
+	}
+	if pa.major != pb.major {
+		return pb.major - pa.major
+	}
+	return pb.prerelease - pa.prerelease
+}
+
+type kubeAwareVersion struct {
+	major      int
+	band       int // 2 = GA, 1 = beta, 0 = alpha
+	prerelease int
+}
+
+func parseKubeAwareVersion(v string) (kubeAwareVersion, bool) {
+	m := kubeAwareVersionPattern.FindStringSubmatch(v)
+	if m == nil {
+		return kubeAwareVersion{}, false
+	}
+	major, _ := strconv.Atoi(m[1])
+	band := 2
+	if m[2] == "beta" {
+		band = 1
+	} else if m[2] == "alpha" {
+		band = 0
+	}
+	prerelease := 0
+	if m[3] != "" {
+		prerelease, _ = strconv.Atoi(m[3])
+	}
+	return kubeAwareVersion{major: major, band: band, prerelease: prerelease}, true
+}
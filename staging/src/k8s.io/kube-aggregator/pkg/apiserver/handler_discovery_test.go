@@ -18,11 +18,13 @@ package apiserver
 
 import (
 	"context"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"sort"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -488,6 +490,109 @@ func TestLegacyFallback(t *testing.T) {
 	}, doc.Items)
 }
 
+// Exercises the legacy fallback ETag/body-hash cache: the upstream legacy resource list handler
+// should only be re-parsed and re-converted into the merged discovery document when its content
+// actually changes, not on every sync.
+func TestLegacyFallbackCache(t *testing.T) {
+	aggregatedResourceManager := discoveryendpoint.NewResourceManager()
+	rootAPIsHandler := discovery.NewRootAPIsHandler(discovery.DefaultAddresses{DefaultAddress: "192.168.1.1"}, scheme.Codecs)
+
+	legacyGroupHandler := discovery.NewAPIGroupHandler(scheme.Codecs, metav1.APIGroup{
+		Name: "stable.example.com",
+		PreferredVersion: metav1.GroupVersionForDiscovery{
+			GroupVersion: "stable.example.com/v1",
+			Version:      "v1",
+		},
+		Versions: []metav1.GroupVersionForDiscovery{
+			{
+				GroupVersion: "stable.example.com/v1",
+				Version:      "v1",
+			},
+		},
+	})
+
+	var versionCounter int32 = 1
+	var fullServes int32
+
+	legacyResourceHandler := discovery.NewAPIVersionHandler(scheme.Codecs, schema.GroupVersion{
+		Group:   "stable.example.com",
+		Version: "v1",
+	}, discovery.APIResourceListerFunc(func() []metav1.APIResource {
+		atomic.AddInt32(&fullServes, 1)
+		return []metav1.APIResource{
+			{
+				Name:         "foos",
+				SingularName: "foo",
+				Group:        "stable.example.com",
+				Version:      "v1",
+				Namespaced:   false,
+				Kind:         fmt.Sprintf("Foo%d", atomic.LoadInt32(&versionCounter)),
+				Verbs:        []string{"get", "list", "watch"},
+				Categories:   []string{"all"},
+			},
+		}
+	}))
+
+	handlerFunc := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/apis/stable.example.com":
+			legacyGroupHandler.ServeHTTP(w, r)
+		case "/apis/stable.example.com/v1":
+			legacyResourceHandler.ServeHTTP(w, r)
+		case "/apis":
+			rootAPIsHandler.ServeHTTP(w, r)
+		default:
+			t.Fatalf("unexpected request sent to %v", r.URL.Path)
+		}
+	})
+
+	aggregatedManager := newDiscoveryManager(aggregatedResourceManager)
+	apiServiceName := "v1.stable.example.com"
+	aggregatedManager.AddAPIService(&apiregistrationv1.APIService{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: apiServiceName,
+		},
+		Spec: apiregistrationv1.APIServiceSpec{
+			Group:   "stable.example.com",
+			Version: "v1",
+			Service: &apiregistrationv1.ServiceReference{
+				Name: "test-service",
+			},
+		},
+	}, handlerFunc)
+
+	testCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go aggregatedManager.Run(testCtx.Done())
+	require.True(t, waitForEmptyQueue(testCtx.Done(), aggregatedManager))
+
+	require.EqualValues(t, 1, atomic.LoadInt32(&fullServes), "expected exactly one full fetch on initial sync")
+	_, firstBytes, firstDoc := fetchPath(aggregatedResourceManager, "")
+	require.Equal(t, "Foo1", firstDoc.Items[0].Versions[0].Resources[0].ResponseKind.Kind)
+
+	// Resync without anything changing upstream: the handler is still hit (so that we'd notice a
+	// real change), but since the body hash is identical the merged document must be byte-for-byte
+	// stable and come from cache rather than a fresh conversion.
+	aggregatedManager.dirtyAPIServiceQueue.Add(apiServiceName)
+	require.True(t, waitForEmptyQueue(testCtx.Done(), aggregatedManager))
+
+	require.EqualValues(t, 2, atomic.LoadInt32(&fullServes), "expected the handler to be hit again on resync")
+	_, secondBytes, _ := fetchPath(aggregatedResourceManager, "")
+	require.Equal(t, firstBytes, secondBytes, "merged discovery document should be unchanged when upstream content hasn't changed")
+
+	// Now actually change the upstream resource list and bump the version counter, and confirm the
+	// merged document picks up the change.
+	atomic.StoreInt32(&versionCounter, 2)
+	aggregatedManager.dirtyAPIServiceQueue.Add(apiServiceName)
+	require.True(t, waitForEmptyQueue(testCtx.Done(), aggregatedManager))
+
+	require.EqualValues(t, 3, atomic.LoadInt32(&fullServes))
+	_, thirdBytes, thirdDoc := fetchPath(aggregatedResourceManager, "")
+	require.NotEqual(t, firstBytes, thirdBytes, "merged discovery document should change once upstream content changes")
+	require.Equal(t, "Foo2", thirdDoc.Items[0].Versions[0].Resources[0].ResponseKind.Kind)
+}
+
 // Exercises the 304 Not Modified Path of the aggregator
 // This path in 1.26.0 would result in a deadlock if an aggregated APIService
 // returned a 304 Not Modified response for its own aggregated discovery document.
@@ -547,6 +652,137 @@ func TestNotModified(t *testing.T) {
 	require.True(t, waitForEmptyQueue(testCtx.Done(), aggregatedManager))
 }
 
+// TestHungAPIServiceDoesNotStarveOthers shows that a worker stuck waiting on an APIService whose
+// handler never responds doesn't prevent the other workers from reconciling the rest of the
+// queue: the hung APIService is bounded by the per-request timeout, and the remaining APIServices
+// are free to sync concurrently on the other workers.
+func TestHungAPIServiceDoesNotStarveOthers(t *testing.T) {
+	aggregatedResourceManager := discoveryendpoint.NewResourceManager()
+	healthyService := discoveryendpoint.NewResourceManager()
+	apiGroup := fuzzAPIGroups(1, 1, 77)
+	healthyService.SetGroups(apiGroup.Items)
+
+	aggregatedManager := NewDiscoveryManager(
+		aggregatedResourceManager,
+		WithParallelism(2),
+		WithPerRequestTimeout(200*time.Millisecond),
+	).(*discoveryManager)
+
+	aggregatedManager.AddAPIService(&apiregistrationv1.APIService{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "v1.hung.example.com",
+		},
+		Spec: apiregistrationv1.APIServiceSpec{
+			Group:   "hung.example.com",
+			Version: "v1",
+			Service: &apiregistrationv1.ServiceReference{
+				Name: "hung-service",
+			},
+		},
+	}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Never responds.
+		<-make(chan struct{})
+	}))
+
+	for _, g := range apiGroup.Items {
+		for _, v := range g.Versions {
+			aggregatedManager.AddAPIService(&apiregistrationv1.APIService{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: v.Version + "." + g.Name,
+				},
+				Spec: apiregistrationv1.APIServiceSpec{
+					Group:   g.Name,
+					Version: v.Version,
+					Service: &apiregistrationv1.ServiceReference{
+						Name: "healthy-service",
+					},
+				},
+			}, healthyService)
+		}
+	}
+
+	testCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	go aggregatedManager.Run(testCtx.Done())
+
+	require.Eventually(t, func() bool {
+		_, _, doc := fetchPath(aggregatedResourceManager, "")
+		if doc == nil {
+			return false
+		}
+		for _, group := range doc.Items {
+			if group.Name == apiGroup.Items[0].Name {
+				return true
+			}
+		}
+		return false
+	}, 4*time.Second, 50*time.Millisecond, "healthy APIService should reconcile despite a hung sibling")
+}
+
+// TestCircuitBreakerRecoversOnUnchangedContent shows that an APIService marked Stale by the
+// circuit breaker goes back to Current once it starts syncing successfully again, even if the
+// content it serves never actually changed (e.g. it recovered from a transient network blip and
+// the very next successful sync is an aggregated 304 Not Modified).
+func TestCircuitBreakerRecoversOnUnchangedContent(t *testing.T) {
+	aggregatedResourceManager := discoveryendpoint.NewResourceManager()
+	service := discoveryendpoint.NewResourceManager()
+	service.SetGroups([]apidiscoveryv2beta1.APIGroupDiscovery{
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "stable.example.com"},
+			Versions: []apidiscoveryv2beta1.APIVersionDiscovery{
+				{Version: "v1", Freshness: apidiscoveryv2beta1.DiscoveryFreshnessCurrent},
+			},
+		},
+	})
+
+	var down int32
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&down) == 1 {
+			http.Error(w, "backing service down", http.StatusInternalServerError)
+			return
+		}
+		service.ServeHTTP(w, r)
+	})
+
+	aggregatedManager := newDiscoveryManager(aggregatedResourceManager)
+	aggregatedManager.AddAPIService(&apiregistrationv1.APIService{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "v1.stable.example.com",
+		},
+		Spec: apiregistrationv1.APIServiceSpec{
+			Group:   "stable.example.com",
+			Version: "v1",
+			Service: &apiregistrationv1.ServiceReference{
+				Name: "test-service",
+			},
+		},
+	}, handler)
+
+	testCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	go aggregatedManager.Run(testCtx.Done())
+	require.True(t, waitForEmptyQueue(testCtx.Done(), aggregatedManager))
+
+	_, _, doc := fetchPath(aggregatedResourceManager, "")
+	require.Len(t, doc.Items, 1)
+	require.Equal(t, apidiscoveryv2beta1.DiscoveryFreshnessCurrent, doc.Items[0].Versions[0].Freshness)
+
+	atomic.StoreInt32(&down, 1)
+	aggregatedManager.dirtyAPIServiceQueue.Add("v1.stable.example.com")
+	require.Eventually(t, func() bool {
+		_, _, doc := fetchPath(aggregatedResourceManager, "")
+		return len(doc.Items) == 1 && doc.Items[0].Versions[0].Freshness == apidiscoveryv2beta1.DiscoveryFreshnessStale
+	}, 5*time.Second, 20*time.Millisecond, "APIService should be marked Stale after repeated failures")
+
+	atomic.StoreInt32(&down, 0)
+	require.Eventually(t, func() bool {
+		_, _, doc := fetchPath(aggregatedResourceManager, "")
+		return len(doc.Items) == 1 && doc.Items[0].Versions[0].Freshness == apidiscoveryv2beta1.DiscoveryFreshnessCurrent
+	}, 5*time.Second, 20*time.Millisecond, "APIService should recover to Current once syncs succeed again, even though its content never changed")
+}
+
 // copied from staging/src/k8s.io/apiserver/pkg/endpoints/discovery/v2/handler_test.go
 func fuzzAPIGroups(atLeastNumGroups, maxNumGroups int, seed int64) apidiscoveryv2beta1.APIGroupDiscoveryList {
 	fuzzer := fuzz.NewWithSeed(seed)
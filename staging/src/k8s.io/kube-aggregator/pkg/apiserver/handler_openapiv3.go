@@ -0,0 +1,339 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apiserver
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"k8s.io/klog/v2"
+
+	apidiscoveryv2beta1 "k8s.io/api/apidiscovery/v2beta1"
+	"k8s.io/client-go/util/workqueue"
+	apiregistrationv1 "k8s.io/kube-aggregator/pkg/apis/apiregistration/v1"
+)
+
+// OpenAPIV3AggregationManager keeps track of the OpenAPI v3 documents for a list of APIServices,
+// merges them into a single /openapi/v3 index plus per group-version documents, and updates them
+// when they change. It mirrors DiscoveryManager's architecture, but for OpenAPI v3 instead of the
+// apidiscovery.k8s.io document.
+type OpenAPIV3AggregationManager interface {
+	// AddAPIService adds an APIService to be tracked by the manager. If the APIService is already
+	// known, its OpenAPI v3 documents will be re-fetched the next time it is synced.
+	AddAPIService(apiService *apiregistrationv1.APIService, handler http.Handler)
+
+	// RemoveAPIService removes an APIService from being tracked, and removes its contribution to
+	// the merged index the next time it is synced.
+	RemoveAPIService(apiServiceName string)
+
+	// Run starts the manager and blocks, reconciling the merged index until stopCh is closed.
+	Run(stopCh <-chan struct{})
+
+	// ServeHTTP serves the merged /openapi/v3 index and the per group-version documents behind
+	// it.
+	http.Handler
+}
+
+// openAPIAggregationManager is the OpenAPI v3 analogue of discoveryManager: each time an
+// APIService is added, removed, or believed to have changed, its name is pushed onto
+// dirtyAPIServiceQueue; the Run loop drains that queue, re-fetches the affected APIService's
+// OpenAPI v3 documents, and rebuilds the merged index.
+type openAPIAggregationManager struct {
+	resourceManager *openAPIV3ResourceManager
+
+	mu              sync.RWMutex
+	liveAPIServices map[string]*apiregistrationv1.APIService
+	handlers        map[string]http.Handler
+
+	// resultsLock guards results, which is read whenever the merged index is rebuilt and written
+	// whenever an APIService's own documents change.
+	resultsLock sync.RWMutex
+	// results holds the most recently fetched group-version document contributed by each known
+	// APIService, keyed by APIService name.
+	results map[string]openAPIV3GroupVersionEntry
+
+	// fetchCache holds the ETag/body-hash cache used when fetching each APIService's /openapi/v3
+	// and /openapi/v3/apis/<group>/<version> documents.
+	fetchCache *legacyDiscoveryCache
+
+	dirtyAPIServiceQueue workqueue.RateLimitingInterface
+}
+
+// openAPIV3GroupVersionEntry is a single APIService's contribution to the merged OpenAPI v3
+// index: the group-version path it backs, its last known-good document, and whether that
+// document is still considered fresh.
+type openAPIV3GroupVersionEntry struct {
+	path      string
+	body      []byte
+	freshness apidiscoveryv2beta1.DiscoveryFreshness
+}
+
+// NewOpenAPIV3AggregationManager returns an OpenAPIV3AggregationManager serving its own merged
+// /openapi/v3 document.
+func NewOpenAPIV3AggregationManager() OpenAPIV3AggregationManager {
+	return &openAPIAggregationManager{
+		resourceManager:      newOpenAPIV3ResourceManager(),
+		liveAPIServices:      map[string]*apiregistrationv1.APIService{},
+		handlers:             map[string]http.Handler{},
+		results:              map[string]openAPIV3GroupVersionEntry{},
+		fetchCache:           newLegacyDiscoveryCache(),
+		dirtyAPIServiceQueue: workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "openapiv3-aggregation-manager"),
+	}
+}
+
+func (om *openAPIAggregationManager) AddAPIService(apiService *apiregistrationv1.APIService, handler http.Handler) {
+	om.mu.Lock()
+	defer om.mu.Unlock()
+	om.liveAPIServices[apiService.Name] = apiService
+	om.handlers[apiService.Name] = handler
+	om.dirtyAPIServiceQueue.Add(apiService.Name)
+}
+
+func (om *openAPIAggregationManager) RemoveAPIService(apiServiceName string) {
+	om.mu.Lock()
+	defer om.mu.Unlock()
+	delete(om.liveAPIServices, apiServiceName)
+	delete(om.handlers, apiServiceName)
+	om.dirtyAPIServiceQueue.Add(apiServiceName)
+}
+
+func (om *openAPIAggregationManager) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	om.resourceManager.ServeHTTP(w, r)
+}
+
+func (om *openAPIAggregationManager) Run(stopCh <-chan struct{}) {
+	defer om.dirtyAPIServiceQueue.ShutDown()
+
+	klog.Info("Starting OpenAPIV3AggregationManager")
+	defer klog.Info("Shutting down OpenAPIV3AggregationManager")
+
+	go func() {
+		<-stopCh
+		om.dirtyAPIServiceQueue.ShutDown()
+	}()
+
+	for om.processNextWorkItem() {
+	}
+}
+
+func (om *openAPIAggregationManager) processNextWorkItem() bool {
+	next, shutdown := om.dirtyAPIServiceQueue.Get()
+	if shutdown {
+		return false
+	}
+	defer om.dirtyAPIServiceQueue.Done(next)
+
+	om.syncAPIService(next.(string))
+	om.dirtyAPIServiceQueue.Forget(next)
+	return true
+}
+
+// syncAPIService re-fetches the OpenAPI v3 document contributed by the named APIService (or
+// forgets it, if it has been removed), marks it Stale if the APIService is unreachable, and
+// rebuilds the merged index if anything changed.
+func (om *openAPIAggregationManager) syncAPIService(name string) {
+	om.mu.RLock()
+	apiService, stillExists := om.liveAPIServices[name]
+	handler := om.handlers[name]
+	om.mu.RUnlock()
+
+	if !stillExists {
+		om.forgetAPIService(name)
+		om.rebuildMergedIndex()
+		return
+	}
+
+	path := fmt.Sprintf("apis/%s/%s", apiService.Spec.Group, apiService.Spec.Version)
+
+	// Touch the root index so misbehaving delegates that don't serve OpenAPI v3 at all are
+	// detected before we bother asking for the group-version document.
+	if _, _, err := om.fetchCache.get(handler, name, "/openapi/v3"); err != nil {
+		klog.Warningf("APIService %q unreachable fetching /openapi/v3, marking stale: %v", name, err)
+		om.markStale(name)
+		return
+	}
+
+	body, unchanged, err := om.fetchCache.get(handler, name, "/openapi/v3/"+path)
+	if err != nil {
+		klog.Warningf("APIService %q unreachable fetching /openapi/v3/%s, marking stale: %v", name, path, err)
+		om.markStale(name)
+		return
+	}
+
+	if unchanged {
+		om.resultsLock.Lock()
+		if entry, ok := om.results[name]; ok && entry.freshness != apidiscoveryv2beta1.DiscoveryFreshnessCurrent {
+			entry.freshness = apidiscoveryv2beta1.DiscoveryFreshnessCurrent
+			om.results[name] = entry
+			om.rebuildMergedIndexLocked()
+		}
+		om.resultsLock.Unlock()
+		return
+	}
+
+	om.resultsLock.Lock()
+	om.results[name] = openAPIV3GroupVersionEntry{path: path, body: body, freshness: apidiscoveryv2beta1.DiscoveryFreshnessCurrent}
+	om.rebuildMergedIndexLocked()
+	om.resultsLock.Unlock()
+}
+
+func (om *openAPIAggregationManager) forgetAPIService(name string) {
+	om.resultsLock.Lock()
+	delete(om.results, name)
+	om.resultsLock.Unlock()
+	om.fetchCache.forget(name)
+}
+
+// markStale records that name's backing APIService is currently unreachable, without discarding
+// its last known-good document: the merged index keeps serving stale content rather than nothing,
+// but flags it as such. If name has never had a successful fetch there is no document to keep
+// serving, so it is left out of the index entirely rather than publishing an empty placeholder.
+func (om *openAPIAggregationManager) markStale(name string) {
+	om.resultsLock.Lock()
+	defer om.resultsLock.Unlock()
+
+	entry, ok := om.results[name]
+	if !ok {
+		return
+	}
+	entry.freshness = apidiscoveryv2beta1.DiscoveryFreshnessStale
+	om.results[name] = entry
+	om.rebuildMergedIndexLocked()
+}
+
+// rebuildMergedIndexLocked recomputes the merged index from results and publishes it through
+// resourceManager. resultsLock must be held by the caller.
+func (om *openAPIAggregationManager) rebuildMergedIndexLocked() {
+	byPath := map[string]openAPIV3GroupVersionEntry{}
+	for _, entry := range om.results {
+		byPath[entry.path] = entry
+	}
+	om.resourceManager.SetGroupVersions(byPath)
+}
+
+func (om *openAPIAggregationManager) rebuildMergedIndex() {
+	om.resultsLock.Lock()
+	defer om.resultsLock.Unlock()
+	om.rebuildMergedIndexLocked()
+}
+
+// openAPIV3Discovery is the /openapi/v3 root index document: a map from group-version path (e.g.
+// "apis/stable.example.com/v1") to where its document can be fetched.
+type openAPIV3Discovery struct {
+	Paths map[string]openAPIV3DiscoveryGroupVersion `json:"paths"`
+}
+
+type openAPIV3DiscoveryGroupVersion struct {
+	ServerRelativeURL string `json:"serverRelativeURL"`
+	// Freshness mirrors apidiscoveryv2beta1.APIVersionDiscovery's Freshness field: Current means
+	// this document was served by its backing APIService during the last sync, Stale means the
+	// APIService was unreachable and this is the last known-good document.
+	Freshness apidiscoveryv2beta1.DiscoveryFreshness `json:"freshness,omitempty"`
+}
+
+// openAPIV3ResourceManager serves a merged /openapi/v3 root index and the per group-version
+// OpenAPI v3 documents behind it, playing the same role discoveryendpoint.ResourceManager plays
+// for the aggregated discovery document.
+type openAPIV3ResourceManager struct {
+	mu    sync.RWMutex
+	index openAPIV3Discovery
+	docs  map[string]openAPIV3CachedDoc
+}
+
+type openAPIV3CachedDoc struct {
+	body []byte
+	etag string
+}
+
+func newOpenAPIV3ResourceManager() *openAPIV3ResourceManager {
+	return &openAPIV3ResourceManager{docs: map[string]openAPIV3CachedDoc{}}
+}
+
+// SetGroupVersions replaces the manager's entire served index and set of documents.
+func (rm *openAPIV3ResourceManager) SetGroupVersions(groupVersions map[string]openAPIV3GroupVersionEntry) {
+	paths := map[string]openAPIV3DiscoveryGroupVersion{}
+	docs := map[string]openAPIV3CachedDoc{}
+
+	for path, entry := range groupVersions {
+		sum := sha256.Sum256(entry.body)
+		hash := hex.EncodeToString(sum[:])
+		paths[path] = openAPIV3DiscoveryGroupVersion{
+			ServerRelativeURL: fmt.Sprintf("/openapi/v3/%s?hash=%s", path, hash),
+			Freshness:         entry.freshness,
+		}
+		docs[path] = openAPIV3CachedDoc{body: entry.body, etag: strconv.Quote(hash)}
+	}
+
+	rm.mu.Lock()
+	rm.index = openAPIV3Discovery{Paths: paths}
+	rm.docs = docs
+	rm.mu.Unlock()
+}
+
+func (rm *openAPIV3ResourceManager) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/openapi/v3" {
+		rm.serveIndex(w)
+		return
+	}
+	if path := strings.TrimPrefix(r.URL.Path, "/openapi/v3/"); path != r.URL.Path {
+		rm.serveGroupVersion(w, r, path)
+		return
+	}
+	http.NotFound(w, r)
+}
+
+func (rm *openAPIV3ResourceManager) serveIndex(w http.ResponseWriter) {
+	rm.mu.RLock()
+	index := rm.index
+	rm.mu.RUnlock()
+
+	body, err := json.Marshal(index)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
+
+func (rm *openAPIV3ResourceManager) serveGroupVersion(w http.ResponseWriter, r *http.Request, path string) {
+	rm.mu.RLock()
+	doc, ok := rm.docs[path]
+	rm.mu.RUnlock()
+
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	if inm := r.Header.Get("If-None-Match"); inm != "" && inm == doc.etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", doc.etag)
+	w.WriteHeader(http.StatusOK)
+	w.Write(doc.body)
+}
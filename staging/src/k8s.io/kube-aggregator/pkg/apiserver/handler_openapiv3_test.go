@@ -0,0 +1,196 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apiserver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	apidiscoveryv2beta1 "k8s.io/api/apidiscovery/v2beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+	apiregistrationv1 "k8s.io/kube-aggregator/pkg/apis/apiregistration/v1"
+)
+
+func waitForEmptyOpenAPIQueue(stopCh <-chan struct{}, om *openAPIAggregationManager) bool {
+	return cache.WaitForCacheSync(stopCh, func() bool {
+		return om.dirtyAPIServiceQueue.Len() == 0
+	})
+}
+
+// fakeOpenAPIV3Backend serves a minimal /openapi/v3 root index plus a single group-version
+// document, standing in for an aggregated APIService's own OpenAPI v3 endpoint.
+func fakeOpenAPIV3Backend(t *testing.T, group, version, body string) http.HandlerFunc {
+	path := fmt.Sprintf("apis/%s/%s", group, version)
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/openapi/v3":
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintf(w, `{"paths":{%q:{"serverRelativeURL":"/openapi/v3/%s"}}}`, path, path)
+		case "/openapi/v3/" + path:
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(body))
+		default:
+			t.Fatalf("unexpected request to %v", r.URL.Path)
+		}
+	}
+}
+
+func fetchOpenAPIV3Index(t *testing.T, handler http.Handler) openAPIV3Discovery {
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/openapi/v3", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var index openAPIV3Discovery
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &index))
+	return index
+}
+
+// TestOpenAPIV3Basic shows that documents from two distinct APIServices both show up in the
+// merged index.
+func TestOpenAPIV3Basic(t *testing.T) {
+	manager := NewOpenAPIV3AggregationManager().(*openAPIAggregationManager)
+
+	manager.AddAPIService(&apiregistrationv1.APIService{
+		ObjectMeta: metav1.ObjectMeta{Name: "v1.stable.example.com"},
+		Spec: apiregistrationv1.APIServiceSpec{
+			Group:   "stable.example.com",
+			Version: "v1",
+			Service: &apiregistrationv1.ServiceReference{Name: "service1"},
+		},
+	}, fakeOpenAPIV3Backend(t, "stable.example.com", "v1", `{"openapi":"3.0.0","info":{"title":"stable"}}`))
+
+	manager.AddAPIService(&apiregistrationv1.APIService{
+		ObjectMeta: metav1.ObjectMeta{Name: "v1beta1.other.example.com"},
+		Spec: apiregistrationv1.APIServiceSpec{
+			Group:   "other.example.com",
+			Version: "v1beta1",
+			Service: &apiregistrationv1.ServiceReference{Name: "service2"},
+		},
+	}, fakeOpenAPIV3Backend(t, "other.example.com", "v1beta1", `{"openapi":"3.0.0","info":{"title":"other"}}`))
+
+	testCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go manager.Run(testCtx.Done())
+	require.True(t, waitForEmptyOpenAPIQueue(testCtx.Done(), manager))
+
+	index := fetchOpenAPIV3Index(t, manager)
+	require.Contains(t, index.Paths, "apis/stable.example.com/v1")
+	require.Contains(t, index.Paths, "apis/other.example.com/v1beta1")
+	require.Equal(t, apidiscoveryv2beta1.DiscoveryFreshnessCurrent, index.Paths["apis/stable.example.com/v1"].Freshness)
+
+	w := httptest.NewRecorder()
+	manager.ServeHTTP(w, httptest.NewRequest("GET", "/openapi/v3/apis/stable.example.com/v1", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.JSONEq(t, `{"openapi":"3.0.0","info":{"title":"stable"}}`, w.Body.String())
+}
+
+// TestOpenAPIV3RemoveAPIService shows that a removed APIService's group-version disappears from
+// the merged index.
+func TestOpenAPIV3RemoveAPIService(t *testing.T) {
+	manager := NewOpenAPIV3AggregationManager().(*openAPIAggregationManager)
+
+	apiService := &apiregistrationv1.APIService{
+		ObjectMeta: metav1.ObjectMeta{Name: "v1.stable.example.com"},
+		Spec: apiregistrationv1.APIServiceSpec{
+			Group:   "stable.example.com",
+			Version: "v1",
+			Service: &apiregistrationv1.ServiceReference{Name: "service1"},
+		},
+	}
+	manager.AddAPIService(apiService, fakeOpenAPIV3Backend(t, "stable.example.com", "v1", `{"openapi":"3.0.0"}`))
+
+	testCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go manager.Run(testCtx.Done())
+	require.True(t, waitForEmptyOpenAPIQueue(testCtx.Done(), manager))
+	require.Contains(t, fetchOpenAPIV3Index(t, manager).Paths, "apis/stable.example.com/v1")
+
+	manager.RemoveAPIService(apiService.Name)
+	require.True(t, waitForEmptyOpenAPIQueue(testCtx.Done(), manager))
+	require.NotContains(t, fetchOpenAPIV3Index(t, manager).Paths, "apis/stable.example.com/v1")
+}
+
+// TestOpenAPIV3Stale shows that when an APIService becomes unreachable its last known-good
+// document is kept in the merged index, but flagged Stale instead of Current.
+func TestOpenAPIV3Stale(t *testing.T) {
+	manager := NewOpenAPIV3AggregationManager().(*openAPIAggregationManager)
+
+	up := true
+	backend := fakeOpenAPIV3Backend(t, "stable.example.com", "v1", `{"openapi":"3.0.0"}`)
+	apiService := &apiregistrationv1.APIService{
+		ObjectMeta: metav1.ObjectMeta{Name: "v1.stable.example.com"},
+		Spec: apiregistrationv1.APIServiceSpec{
+			Group:   "stable.example.com",
+			Version: "v1",
+			Service: &apiregistrationv1.ServiceReference{Name: "service1"},
+		},
+	}
+	manager.AddAPIService(apiService, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !up {
+			http.Error(w, "backend down", http.StatusServiceUnavailable)
+			return
+		}
+		backend(w, r)
+	}))
+
+	testCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go manager.Run(testCtx.Done())
+	require.True(t, waitForEmptyOpenAPIQueue(testCtx.Done(), manager))
+	require.Equal(t, apidiscoveryv2beta1.DiscoveryFreshnessCurrent, fetchOpenAPIV3Index(t, manager).Paths["apis/stable.example.com/v1"].Freshness)
+
+	up = false
+	manager.dirtyAPIServiceQueue.Add(apiService.Name)
+	require.True(t, waitForEmptyOpenAPIQueue(testCtx.Done(), manager))
+
+	index := fetchOpenAPIV3Index(t, manager)
+	require.Contains(t, index.Paths, "apis/stable.example.com/v1", "stale entries must not be dropped from the index")
+	require.Equal(t, apidiscoveryv2beta1.DiscoveryFreshnessStale, index.Paths["apis/stable.example.com/v1"].Freshness)
+}
+
+// TestOpenAPIV3StaleNeverFetched shows that an APIService whose very first sync fails never gets
+// a placeholder entry in the merged index: there is no known-good document to mark stale, so it
+// must simply be absent rather than served as an empty "current" document.
+func TestOpenAPIV3StaleNeverFetched(t *testing.T) {
+	manager := NewOpenAPIV3AggregationManager().(*openAPIAggregationManager)
+
+	apiService := &apiregistrationv1.APIService{
+		ObjectMeta: metav1.ObjectMeta{Name: "v1.stable.example.com"},
+		Spec: apiregistrationv1.APIServiceSpec{
+			Group:   "stable.example.com",
+			Version: "v1",
+			Service: &apiregistrationv1.ServiceReference{Name: "service1"},
+		},
+	}
+	manager.AddAPIService(apiService, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "backend down", http.StatusServiceUnavailable)
+	}))
+
+	testCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go manager.Run(testCtx.Done())
+	require.True(t, waitForEmptyOpenAPIQueue(testCtx.Done(), manager))
+
+	require.NotContains(t, fetchOpenAPIV3Index(t, manager).Paths, "apis/stable.example.com/v1",
+		"an APIService that has never successfully synced must not appear in the index")
+}
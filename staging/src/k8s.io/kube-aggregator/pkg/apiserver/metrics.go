@@ -0,0 +1,56 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apiserver
+
+import (
+	"k8s.io/component-base/metrics"
+	"k8s.io/component-base/metrics/legacyregistry"
+)
+
+var (
+	discoverySyncDuration = metrics.NewHistogramVec(
+		&metrics.HistogramOpts{
+			Name:           "aggregator_discovery_sync_duration_seconds",
+			Help:           "Time in seconds it took to sync (or fail to sync) a single APIService's discovery document, keyed by APIService name.",
+			Buckets:        metrics.ExponentialBuckets(0.001, 2, 15),
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"apiservice"},
+	)
+
+	discoverySyncFailuresTotal = metrics.NewCounterVec(
+		&metrics.CounterOpts{
+			Name:           "aggregator_discovery_sync_failures_total",
+			Help:           "Number of failed discovery document syncs, keyed by APIService name.",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"apiservice"},
+	)
+
+	discoverySyncCircuitOpen = metrics.NewGaugeVec(
+		&metrics.GaugeOpts{
+			Name:           "aggregator_discovery_sync_circuit_open",
+			Help:           "Whether the discovery sync circuit breaker for an APIService is currently open (1) or closed (0).",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"apiservice"},
+	)
+)
+
+func init() {
+	legacyregistry.MustRegister(discoverySyncDuration, discoverySyncFailuresTotal, discoverySyncCircuitOpen)
+}